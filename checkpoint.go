@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/net/context"
+	elastic "gopkg.in/olivere/elastic.v5"
+)
+
+// pipelineUnit carries a single hit through the scroll -> deserialize -> sink
+// pipeline. seq and sortKey are only meaningful in -checkpoint mode, where
+// they let the sink stage advance the checkpoint without skipping over a
+// hit that hasn't actually been written yet.
+type pipelineUnit struct {
+	raw     elastic.SearchHit
+	hit     Hit
+	seq     uint64
+	sortKey []interface{}
+}
+
+// readCheckpoint loads the last acknowledged sort key from path. A missing
+// file is not an error: it just means -resume has nothing to resume from
+// yet, so the scroll starts from the beginning.
+func readCheckpoint(path string) ([]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var key []interface{}
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// writeCheckpointFile atomically overwrites path with key, so a crash
+// mid-write never leaves behind a corrupt or partial checkpoint.
+func writeCheckpointFile(path string, key []interface{}) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// watermark tracks out-of-order hit completions so a checkpoint never
+// advances past a hit that hasn't been acknowledged yet: it only moves
+// forward through a contiguous run of acknowledged sequence numbers,
+// holding later ones back until the gap in front of them closes.
+type watermark struct {
+	mu      sync.Mutex
+	next    uint64
+	pending map[uint64][]interface{}
+}
+
+func newWatermark() *watermark {
+	return &watermark{pending: make(map[uint64][]interface{})}
+}
+
+// ack records that seq has been processed and returns the new low-watermark
+// sort key if it advanced, or nil if seq is still waiting behind a gap.
+func (w *watermark) ack(seq uint64, sortKey []interface{}) []interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending[seq] = sortKey
+	var advanced []interface{}
+	for {
+		key, ok := w.pending[w.next]
+		if !ok {
+			break
+		}
+		advanced = key
+		delete(w.pending, w.next)
+		w.next++
+	}
+	return advanced
+}
+
+// checkpointer wires a watermark to a checkpoint file on disk, persisting
+// the low-watermark sort key every time it advances.
+type checkpointer struct {
+	path string
+	wm   *watermark
+}
+
+func newCheckpointer(path string) *checkpointer {
+	return &checkpointer{path: path, wm: newWatermark()}
+}
+
+func (c *checkpointer) ack(seq uint64, sortKey []interface{}) error {
+	advanced := c.wm.ack(seq, sortKey)
+	if advanced == nil {
+		return nil
+	}
+	return writeCheckpointFile(c.path, advanced)
+}
+
+// scrollSearchAfter is an alternative to the Scroll-API producer: it walks
+// the result set with search_after on a deterministic sort (-slice-field is
+// reused as the tiebreaker), resuming from "after" when non-empty. -slices
+// is ignored in this mode, since search_after has no scroll-context expiry
+// for slicing to work around; a single ordered stream is enough.
+func scrollSearchAfter(ctx context.Context, client *elastic.Client, query elastic.Query, after []interface{}, hits chan<- pipelineUnit) error {
+	var seq uint64
+	for {
+		search := client.Search(indexName).Type(typeName).Query(query).Sort(*sliceField, true).Size(size)
+		if len(after) > 0 {
+			search = search.SearchAfter(after...)
+		}
+
+		results, err := search.Do(ctx)
+		if err != nil {
+			return err
+		}
+		if len(results.Hits.Hits) == 0 {
+			return nil // all results retrieved
+		}
+
+		// This is a select, not a plain send, so a canceled ctx (e.g. because
+		// the sink downstream gave up) unblocks us even if nothing is reading
+		// from hits anymore, instead of parking here forever.
+		for _, hit := range results.Hits.Hits {
+			select {
+			case hits <- pipelineUnit{raw: *hit, seq: seq, sortKey: hit.Sort}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			seq++
+			after = hit.Sort
+		}
+
+		select {
+		default:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
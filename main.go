@@ -2,13 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
+	"fmt"
 	"io"
+	"os"
+	"time"
 
 	"golang.org/x/net/context"
-	"golang.org/x/sync/errgroup"
 	"gopkg.in/cheggaaa/pb.v1"
 	elastic "gopkg.in/olivere/elastic.v5"
-	"io/ioutil"
 )
 
 type Hit struct {
@@ -26,7 +28,35 @@ const (
 	size      = 100 // https://www.elastic.co/guide/en/elasticsearch/guide/2.x/scroll.html
 )
 
+var (
+	slices     = flag.Int("slices", 1, "number of parallel sliced-scroll workers (ES 5.0+ sliced scroll); 1 disables slicing")
+	sliceField = flag.String("slice-field", "_uid", "field ES partitions slices on, passed to the slice query")
+
+	output       = flag.String("output", "data.json", "output file path; use '-' for stdout")
+	outputFormat = flag.String("format", "ndjson", "output format: ndjson (one hit per line) or bulk (ES _bulk format)")
+	outputGzip   = flag.Bool("gzip", false, "gzip-compress the output")
+
+	reindex           = flag.Bool("reindex", false, "stream hits into another Elasticsearch cluster instead of writing them to -output")
+	destURL           = flag.String("dest-url", "http://localhost:9200", "destination cluster URL, used with -reindex")
+	destIndex         = flag.String("dest-index", "", "destination index, used with -reindex")
+	destType          = flag.String("dest-type", "", "destination type, used with -reindex")
+	bulkWorkers       = flag.Int("bulk-workers", 4, "BulkProcessor worker count, used with -reindex")
+	bulkBatchSize     = flag.Int("bulk-batch-size", 500, "BulkProcessor batch size, used with -reindex")
+	bulkFlushInterval = flag.Duration("bulk-flush-interval", 5*time.Second, "BulkProcessor flush interval, used with -reindex")
+
+	checkpoint = flag.String("checkpoint", "", "checkpoint file path; switches the producer from Scroll to search_after (ignoring -slices) and resumes from this file with -resume")
+	resume     = flag.Bool("resume", false, "resume from the sort key stored in -checkpoint instead of starting from the beginning")
+)
+
 func main() {
+	flag.Parse()
+
+	if *slices < 1 {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid -slices %d: must be >= 1\n", *slices)
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	client, err := elastic.NewClient(
 		elastic.SetSniff(false), // Set sniff to false to fix "no Elasticsearch node available" error
 	)
@@ -49,103 +79,194 @@ func main() {
 	//
 	// It uses the excellent golang.org/x/sync/errgroup package to do so.
 	//
-	// The first goroutine will Scroll through the result set and send
-	// individual documents to a channel.
+	// The first goroutine (or, when -slices > 1, the first cluster of
+	// goroutines, one per slice) will Scroll through the result set and
+	// send individual documents to a channel.
 	//
 	// The second cluster of goroutines will receive documents from the channel and
 	// deserialize them.
 	//
-	// Feel free to add a third goroutine to do something with the
-	// deserialized results.
+	// The third goroutine streams the deserialized results into a Sink (see
+	// sink.go) one hit at a time, so the full result set is never held in
+	// memory.
 	//
 	// Let's go.
 
-	// 1st goroutine sends individual hits to channel.
+	// -checkpoint switches the producer below from the Scroll API to
+	// search_after, and, with -resume, picks up from wherever the last run
+	// left off instead of starting over.
+	var cp *checkpointer
+	var resumeAfter []interface{}
+	if *checkpoint != "" {
+		cp = newCheckpointer(*checkpoint)
+		if *resume {
+			resumeAfter, err = readCheckpoint(*checkpoint)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	// sliceCounts tracks how many hits each slice has produced, so we can
+	// report a per-slice breakdown alongside the shared progress bar once
+	// the extract finishes.
+	sliceCounts := make([]int, *slices)
+
+	// 1st goroutine(s) send individual hits to channel.
 	// hits := make(chan json.RawMessage)
-	hits := make(chan elastic.SearchHit)
+	hits := make(chan pipelineUnit)
 	// The derived Context is canceled the first time a function passed to Go returns a non-nil error or
-	// the first time Wait returns, whichever occurs first.
-	g, ctx := errgroup.WithContext(context.Background())
+	// the first time Wait returns, whichever occurs first. We use our own Group (see safegroup.go) instead of a
+	// bare errgroup.Group so a panic in any worker (scroll producer, deserializer, sink) is reported as
+	// an error instead of crashing the whole extract job.
+	g, ctx := WithContext(context.Background())
 	g.Go(func() error {
 		defer close(hits)
-		// Initialize scroller. Just don't call Do yet.
-		scroll := client.Scroll(indexName).Type(typeName).Query(query).Size(size)
-		for {
-			results, err := scroll.Do(ctx)
-			if err == io.EOF {
-				return nil // all results retrieved
-			}
-			if err != nil {
-				return err // something went wrong
-			}
 
-			// Send the hits to the hits channel
-			for _, hit := range results.Hits.Hits {
-				// We save search hit instead of _source so that _id is included.
-				hits <- *hit
-			}
+		if cp != nil {
+			return scrollSearchAfter(ctx, client, query, resumeAfter, hits)
+		}
 
-			// Check if we need to terminate early
-			select {
-			default:
-			case <-ctx.Done():
-				return ctx.Err()
-			}
+		sg, sctx := WithContext(ctx)
+		for i := 0; i < *slices; i++ {
+			i := i
+			sg.Go(func() error {
+				// Initialize scroller. Just don't call Do yet.
+				scroll := client.Scroll(indexName).Type(typeName).Query(query).Size(size)
+				if *slices > 1 {
+					scroll = scroll.Slice(elastic.NewSliceQuery().Id(i).Max(*slices).Field(*sliceField))
+				}
+				for {
+					results, err := scroll.Do(sctx)
+					if err == io.EOF {
+						return nil // all results retrieved for this slice
+					}
+					if err != nil {
+						return err // something went wrong
+					}
+
+					// Send the hits to the shared hits channel. This is a select,
+					// not a plain send, so a canceled sctx (e.g. because the sink
+					// downstream gave up) unblocks us even if nothing is reading
+					// from hits anymore, instead of parking here forever.
+					for _, hit := range results.Hits.Hits {
+						// We save search hit instead of _source so that _id is included.
+						select {
+						case hits <- pipelineUnit{raw: *hit}:
+						case <-sctx.Done():
+							return sctx.Err()
+						}
+					}
+					sliceCounts[i] += len(results.Hits.Hits)
+
+					// Check if we need to terminate early
+					select {
+					default:
+					case <-sctx.Done():
+						return sctx.Err()
+					}
+				}
+			})
 		}
+		return sg.Wait()
 	})
 
-	ch := make(chan Hit)
-	// 2nd cluster of goroutines receive hits and deserializes them.
-	for i := 0; i < 10; i++ {
-		g.Go(func() error {
-			for hit := range hits {
-				// Deserialize
-				var p Source
-				err := json.Unmarshal([]byte(*hit.Source), &p)
-				if err != nil {
-					return err
-				}
+	ch := make(chan pipelineUnit)
+	// 2nd cluster of goroutines receive hits and deserializes them. They're
+	// wrapped in their own sub-group, like the slice producers above, so we
+	// can close ch exactly once, after all of them have finished.
+	g.Go(func() error {
+		defer close(ch)
 
-				// Do something with the product here, e.g. send it to another channel
-				// for further processing.
-				ch <- Hit{ID: hit.Id, Source: p}
+		dg, dctx := WithContext(ctx)
+		for i := 0; i < 10; i++ {
+			dg.Go(func() error {
+				for unit := range hits {
+					// Deserialize
+					var p Source
+					err := json.Unmarshal([]byte(*unit.raw.Source), &p)
+					if err != nil {
+						return err
+					}
 
-				bar.Increment()
+					// Do something with the product here, e.g. send it to another channel
+					// for further processing. This is a select, not a plain send, so a
+					// canceled dctx (e.g. because the sink downstream gave up) unblocks
+					// us even if nothing is reading from ch anymore.
+					unit.hit = Hit{ID: unit.raw.Id, Source: p}
+					select {
+					case ch <- unit:
+					case <-dctx.Done():
+						return dctx.Err()
+					}
 
-				// Terminate early?
-				select {
-				default:
-				case <-ctx.Done():
-					return ctx.Err()
-				}
-			}
-			return nil
-		})
-	}
+					bar.Increment()
 
-	go func() {
-		// Check whether any goroutines failed.
-		if err := g.Wait(); err != nil {
-			panic(err)
+					// Terminate early?
+					select {
+					default:
+					case <-dctx.Done():
+						return dctx.Err()
+					}
+				}
+				return nil
+			})
 		}
-		close(ch)
-	}()
+		return dg.Wait()
+	})
 
-	// The main goroutine (not a 3rd goroutine) handles the deserialized results.
-	// We do not print to stdout in order not to mess up the progress bar.
-	var data []Hit
-	for hit := range ch {
-		data = append(data, hit)
+	var sink Sink
+	if *reindex {
+		sink, err = newReindexSink(ctx, g, *destURL, *destIndex, *destType, *bulkWorkers, *bulkBatchSize, *bulkFlushInterval)
+	} else {
+		sink, err = newSink(*outputFormat, *output, *outputGzip)
 	}
-	jsonData, err := json.Marshal(data)
 	if err != nil {
 		panic(err)
 	}
-	err = ioutil.WriteFile("data.json", jsonData, 0644)
-	if err != nil {
+
+	// 3rd goroutine streams the deserialized results straight into the sink,
+	// acknowledging each one against the checkpoint (if any) once sink.Write
+	// has returned for it, so the checkpoint never advances past an un-acked
+	// hit. An acked hit may still sit in the sink's buffers (the gzip writer,
+	// the reindex BulkProcessor) and is not synced to disk.
+	// We do not print to stdout in order not to mess up the progress bar.
+	//
+	// sink.Close() always runs, even on an early return from a Write/ack
+	// error, via the deferred close below; that early return also cancels
+	// ctx (through the group), which is what unblocks the upstream sends on
+	// hits/ch instead of leaving the whole pipeline parked forever.
+	g.Go(func() (err error) {
+		defer func() {
+			if cerr := sink.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}()
+
+		for unit := range ch {
+			if err := sink.Write(unit.hit); err != nil {
+				return err
+			}
+			if cp != nil {
+				if err := cp.ack(unit.seq, unit.sortKey); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	// Check whether any goroutines failed.
+	if err := g.Wait(); err != nil {
 		panic(err)
 	}
-	
+
 	// Done.
 	bar.FinishPrint("Done")
+
+	if cp == nil && *slices > 1 {
+		for i, count := range sliceCounts {
+			fmt.Printf("slice %d: %d hits\n", i, count)
+		}
+	}
 }
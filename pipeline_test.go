@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var errFakeSinkFailure = errors.New("fake sink failure")
+
+// fakeFailingSink fails once writes exceed failAfter, simulating the kind
+// of unrecoverable destination-cluster bulk failure that reindexSink.Write
+// surfaces from its After callback.
+type fakeFailingSink struct {
+	failAfter int
+	writes    int
+	closed    bool
+}
+
+func (s *fakeFailingSink) Write(Hit) error {
+	s.writes++
+	if s.writes > s.failAfter {
+		return errFakeSinkFailure
+	}
+	return nil
+}
+
+func (s *fakeFailingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+// TestPipeline_SinkErrorAbortsInsteadOfDeadlocking reproduces the
+// scroll -> deserialize -> sink channel topology from main() with a Sink
+// that fails partway through, and asserts the whole pipeline terminates
+// with that error instead of hanging. Every upstream send on hits/ch must
+// be cancellable via ctx.Done() -- otherwise, once the sink-consumer
+// goroutine stops draining ch on a Write error, the deserializer workers
+// block forever sending to ch, which backs up into hits, which backs up
+// into the producer, and g.Wait() never returns.
+func TestPipeline_SinkErrorAbortsInsteadOfDeadlocking(t *testing.T) {
+	g, ctx := WithContext(context.Background())
+
+	hits := make(chan pipelineUnit)
+	g.Go(func() error {
+		defer close(hits)
+		for i := 0; i < 1000; i++ {
+			select {
+			case hits <- pipelineUnit{seq: uint64(i)}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+
+	ch := make(chan pipelineUnit)
+	g.Go(func() error {
+		defer close(ch)
+		for unit := range hits {
+			select {
+			case ch <- unit:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+
+	sink := &fakeFailingSink{failAfter: 5}
+	g.Go(func() (err error) {
+		defer func() {
+			if cerr := sink.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}()
+		for unit := range ch {
+			if err := sink.Write(unit.hit); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- g.Wait() }()
+
+	select {
+	case err := <-done:
+		if err != errFakeSinkFailure {
+			t.Fatalf("g.Wait() = %v, want %v", err, errFakeSinkFailure)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("pipeline deadlocked instead of aborting on a sink error")
+	}
+
+	if !sink.closed {
+		t.Fatal("sink.Close() was never called")
+	}
+}
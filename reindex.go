@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+	elastic "gopkg.in/olivere/elastic.v5"
+)
+
+// reindexSink streams hits into a BulkProcessor targeting a second
+// Elasticsearch cluster/index, giving a Go-native equivalent of the ES
+// `_reindex` API that also works across remote clusters without
+// whitelisting them.
+type reindexSink struct {
+	index string
+	typ   string
+	bp    *elastic.BulkProcessor
+	errCh chan error
+	done  chan struct{}
+}
+
+// newReindexSink dials destURL and returns a Sink that bulk-indexes every
+// hit written to it into destIndex/destType. Failures reported by the
+// BulkProcessor's After callback are fed into g, so the scroll aborts on
+// unrecoverable reindex errors instead of silently dropping documents.
+func newReindexSink(ctx context.Context, g *Group, destURL, destIndex, destType string, workers, batchSize int, flushInterval time.Duration) (*reindexSink, error) {
+	client, err := elastic.NewClient(
+		elastic.SetURL(destURL),
+		elastic.SetSniff(false),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &reindexSink{
+		index: destIndex,
+		typ:   destType,
+		errCh: make(chan error, 1),
+		done:  make(chan struct{}),
+	}
+
+	bp, err := client.BulkProcessor().
+		Workers(workers).
+		BulkActions(batchSize).
+		FlushInterval(flushInterval).
+		After(s.after).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.bp = bp
+
+	g.Go(func() error {
+		select {
+		case err := <-s.errCh:
+			return err
+		case <-s.done:
+			// Close() already drains errCh for the final flush before closing
+			// done, but re-check here in case the two raced: if both this
+			// case and the errCh case above were ready simultaneously, select
+			// could have picked this one and we must not drop a real error.
+			select {
+			case err := <-s.errCh:
+				return err
+			default:
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+
+	return s, nil
+}
+
+// after is the BulkProcessor.After callback: it reports the first
+// unrecoverable failure it sees on errCh, non-blocking so repeated
+// failures after the first don't wedge the bulk processor.
+func (s *reindexSink) after(executionID int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
+	if err != nil {
+		s.reportErr(err)
+		return
+	}
+	if response == nil || !response.Errors {
+		return
+	}
+	for _, failed := range response.Failed() {
+		s.reportErr(fmt.Errorf("bulk index %s/%s/%s failed: %s", failed.Index, failed.Type, failed.Id, failed.Result))
+		return
+	}
+}
+
+func (s *reindexSink) reportErr(err error) {
+	select {
+	case s.errCh <- err:
+	default:
+	}
+}
+
+func (s *reindexSink) Write(hit Hit) error {
+	select {
+	case err := <-s.errCh:
+		return err
+	default:
+	}
+	s.bp.Add(elastic.NewBulkIndexRequest().Index(s.index).Type(s.typ).Id(hit.ID).Doc(hit.Source))
+	return nil
+}
+
+func (s *reindexSink) Close() error {
+	bpErr := s.bp.Close() // flushes and waits for the final batch's After callback
+
+	// A doc-level failure from that final batch lands in errCh synchronously
+	// during the call above; prefer it over bp.Close()'s own (usually nil)
+	// error so a last-batch failure is never reported as success.
+	err := bpErr
+	select {
+	case cbErr := <-s.errCh:
+		err = cbErr
+	default:
+	}
+
+	close(s.done)
+	return err
+}
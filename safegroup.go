@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+)
+
+// PanicError wraps a value recovered from a panic together with the stack
+// trace captured at the point of the panic, so callers can tell a crashed
+// goroutine apart from one that returned a normal error.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v\n%s", e.Value, e.Stack)
+}
+
+// Group is a drop-in replacement for errgroup.Group: it recovers panics
+// raised inside a Go func, turning them into a *PanicError returned from
+// Wait instead of crashing the process. Like errgroup, the first non-nil
+// error (panic or otherwise) cancels the Context returned by WithContext,
+// so a single bad worker never leaves its peers running forever.
+//
+// Callers that want the old crash-the-process behavior can simply panic
+// again on whatever Wait returns.
+type Group struct {
+	g *errgroup.Group
+}
+
+// WithContext mirrors errgroup.WithContext, returning a Group instead of an
+// errgroup.Group.
+func WithContext(ctx context.Context) (*Group, context.Context) {
+	g, ctx := errgroup.WithContext(ctx)
+	return &Group{g: g}, ctx
+}
+
+// Go runs f in a new goroutine. If f panics, the panic is recovered and
+// reported as a *PanicError from Wait, cancelling the group's Context just
+// as a normal error would.
+func (g *Group) Go(f func() error) {
+	g.g.Go(func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = &PanicError{Value: r, Stack: debug.Stack()}
+			}
+		}()
+		return f()
+	})
+}
+
+// Wait blocks until all Go calls have returned, then returns the first
+// non-nil error, which may be a *PanicError.
+func (g *Group) Wait() error {
+	return g.g.Wait()
+}
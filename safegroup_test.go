@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestGroup_ErrorPropagation(t *testing.T) {
+	g, _ := WithContext(context.Background())
+	wantErr := errors.New("boom")
+
+	g.Go(func() error { return wantErr })
+	g.Go(func() error { return nil })
+
+	if err := g.Wait(); err != wantErr {
+		t.Fatalf("Wait() = %v, want %v", err, wantErr)
+	}
+}
+
+func TestGroup_PanicBecomesError(t *testing.T) {
+	g, _ := WithContext(context.Background())
+
+	g.Go(func() error {
+		panic("kaboom")
+	})
+
+	err := g.Wait()
+	if err == nil {
+		t.Fatal("Wait() = nil, want a *PanicError")
+	}
+
+	pe, ok := err.(*PanicError)
+	if !ok {
+		t.Fatalf("Wait() = %T, want *PanicError", err)
+	}
+	if pe.Value != "kaboom" {
+		t.Fatalf("PanicError.Value = %v, want %q", pe.Value, "kaboom")
+	}
+	if len(pe.Stack) == 0 {
+		t.Fatal("PanicError.Stack is empty")
+	}
+}
+
+func TestGroup_CancelsPeersOnPanic(t *testing.T) {
+	g, ctx := WithContext(context.Background())
+
+	peerCanceled := make(chan error, 1)
+	g.Go(func() error {
+		<-ctx.Done()
+		peerCanceled <- ctx.Err()
+		return ctx.Err()
+	})
+	g.Go(func() error {
+		panic("peer should be canceled")
+	})
+
+	if err := g.Wait(); err == nil {
+		t.Fatal("Wait() = nil, want a *PanicError")
+	}
+
+	select {
+	case err := <-peerCanceled:
+		if err == nil {
+			t.Fatal("peer context.Err() = nil, want non-nil")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("peer was never canceled")
+	}
+}
+
+func TestGroup_MultiplePanicsNoDeadlock(t *testing.T) {
+	g, _ := WithContext(context.Background())
+
+	for i := 0; i < 10; i++ {
+		g.Go(func() error {
+			panic("simultaneous panic")
+		})
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- g.Wait() }()
+
+	select {
+	case err := <-done:
+		if _, ok := err.(*PanicError); !ok {
+			t.Fatalf("Wait() = %T, want *PanicError", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait() deadlocked with concurrent panics")
+	}
+}
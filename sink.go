@@ -0,0 +1,120 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Sink consumes deserialized hits one at a time, so an extract job never
+// has to hold the full result set in memory the way the original
+// marshal-everything-then-write-it-out approach did.
+type Sink interface {
+	Write(Hit) error
+	Close() error
+}
+
+// bulkMeta is the action/metadata line ES expects ahead of each source line
+// in the _bulk request body.
+type bulkMeta struct {
+	Index struct {
+		Index string `json:"_index"`
+		Type  string `json:"_type"`
+		ID    string `json:"_id"`
+	} `json:"index"`
+}
+
+// ndjsonSink writes one JSON-encoded hit per line.
+type ndjsonSink struct {
+	enc *json.Encoder
+	c   io.Closer
+}
+
+func (s *ndjsonSink) Write(hit Hit) error {
+	return s.enc.Encode(hit)
+}
+
+func (s *ndjsonSink) Close() error {
+	if s.c == nil {
+		return nil
+	}
+	return s.c.Close()
+}
+
+// bulkSink writes hits as alternating action/metadata and source lines, in
+// the format the ES `_bulk` endpoint expects, so the output file can be fed
+// straight back in for reindexing.
+type bulkSink struct {
+	enc *json.Encoder
+	c   io.Closer
+}
+
+func (s *bulkSink) Write(hit Hit) error {
+	var meta bulkMeta
+	meta.Index.Index = indexName
+	meta.Index.Type = typeName
+	meta.Index.ID = hit.ID
+	if err := s.enc.Encode(meta); err != nil {
+		return err
+	}
+	return s.enc.Encode(hit.Source)
+}
+
+func (s *bulkSink) Close() error {
+	if s.c == nil {
+		return nil
+	}
+	return s.c.Close()
+}
+
+// multiCloser closes every Closer in reverse of the order they were added,
+// returning the first error. Closers are added outermost-writer-last (e.g.
+// the gzip.Writer after the underlying *os.File), so closing in reverse
+// flushes/trailers the outer writers before the file beneath them goes away.
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var err error
+	for i := len(m) - 1; i >= 0; i-- {
+		if cerr := m[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// newSink opens path (use "-" for stdout) and wraps it, optionally through
+// gzip, in the Sink implementation named by format ("ndjson" or "bulk").
+func newSink(format, path string, gzipped bool) (Sink, error) {
+	var w io.Writer
+	var closers multiCloser
+
+	if path == "-" {
+		w = os.Stdout
+	} else {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+		closers = append(closers, f)
+	}
+
+	if gzipped {
+		gw := gzip.NewWriter(w)
+		w = gw
+		closers = append(closers, gw)
+	}
+
+	enc := json.NewEncoder(w)
+	switch format {
+	case "ndjson":
+		return &ndjsonSink{enc: enc, c: closers}, nil
+	case "bulk":
+		return &bulkSink{enc: enc, c: closers}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q (want ndjson or bulk)", format)
+	}
+}